@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxBatchIDs caps how many ids a single batch request may carry.
+const maxBatchIDs = 500
+
+// batchIDsRequest is the JSON body accepted by the POST /batch endpoints,
+// as an alternative to repeated `id=` query parameters.
+type batchIDsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// readBatchIDs collects the ids a batch request asked for, from a JSON
+// `{"ids":[...]}` POST body or repeated `id=` query parameters.
+func readBatchIDs(r *http.Request) ([]string, error) {
+	var ids []string
+
+	if r.Method == http.MethodPost && r.Body != nil {
+		var body batchIDsRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			return nil, err
+		}
+		ids = body.IDs
+	}
+
+	if len(ids) == 0 {
+		ids = r.URL.Query()["id"]
+	}
+
+	if len(ids) > maxBatchIDs {
+		ids = ids[:maxBatchIDs]
+	}
+
+	return ids, nil
+}
+
+// idPlaceholders returns a `?,?,…` placeholder list sized for n ids.
+func idPlaceholders(n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = "?"
+	}
+	return strings.Join(placeholders, ",")
+}
+
+func idsToArgs(ids []string) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+func addAppsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	setSharedHeadersAndLog(w, r, true)
+
+	ids, err := readBatchIDs(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result := make(map[string][]AddApp, len(ids))
+	for _, id := range ids {
+		result[id] = make([]AddApp, 0)
+	}
+
+	if len(ids) > 0 {
+		query := fmt.Sprintf("SELECT parentGameId, id, applicationPath, autoRunBefore, launchCommand, name FROM additional_app WHERE parentGameId IN (%s)", idPlaceholders(len(ids)))
+		rows, err := timedQuery("/addapps/batch", query, idsToArgs(ids)...)
+		if err != nil {
+			errorLog.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		for rows.Next() {
+			var parentGameId string
+			var addApp AddApp
+
+			err := rows.Scan(&parentGameId, &addApp.ID, &addApp.ApplicationPath, &addApp.RunBefore, &addApp.LaunchCommand, &addApp.Name)
+			if err != sql.ErrNoRows && err != nil {
+				errorLog.Println(err)
+				break
+			}
+
+			result[parentGameId] = append(result[parentGameId], addApp)
+		}
+	}
+
+	rowsReturned := 0
+	for _, addApps := range result {
+		rowsReturned += len(addApps)
+	}
+	recordRowsReturned(r, rowsReturned)
+	marshalAndWrite(result, w)
+}
+
+func filesBatchHandler(w http.ResponseWriter, r *http.Request) {
+	setSharedHeadersAndLog(w, r, true)
+
+	ids, err := readBatchIDs(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type filesResult struct {
+		Files []string `json:"files,omitempty"`
+		Error string   `json:"error,omitempty"`
+	}
+
+	result := make(map[string]filesResult, len(ids))
+
+	if len(ids) > 0 {
+		gameZips := make(map[string]string, len(ids))
+
+		query := fmt.Sprintf("SELECT gameId, path FROM game_data WHERE gameId IN (%s)", idPlaceholders(len(ids)))
+		rows, err := timedQuery("/files/batch", query, idsToArgs(ids)...)
+		if err != nil {
+			errorLog.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		for rows.Next() {
+			var id, path string
+			if err := rows.Scan(&id, &path); err != nil && err != sql.ErrNoRows {
+				errorLog.Println(err)
+				break
+			}
+			gameZips[id] = path
+		}
+
+		for _, id := range ids {
+			gameZip, ok := gameZips[id]
+			if !ok {
+				result[id] = filesResult{Error: "not found"}
+				continue
+			}
+
+			reader, err := zip.OpenReader(filepath.Join(config.GameZipPath, gameZip))
+			if err != nil {
+				errorLog.Println(err)
+				result[id] = filesResult{Error: "cannot open archive"}
+				continue
+			}
+
+			files := make([]string, 0)
+			for _, file := range reader.File {
+				if strings.HasPrefix(file.Name, "content/") {
+					files = append(files, strings.TrimPrefix(file.Name, "content/"))
+				}
+			}
+			reader.Close()
+
+			result[id] = filesResult{Files: files}
+		}
+	}
+
+	recordRowsReturned(r, len(result))
+	marshalAndWrite(result, w)
+}
+
+// getBatchHandler streams a zip-of-zips, plus an `errors.json` entry
+// listing any ids that could not be served.
+func getBatchHandler(w http.ResponseWriter, r *http.Request) {
+	setSharedHeadersAndLog(w, r, false)
+
+	ids, err := readBatchIDs(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	gameZips := make(map[string]string, len(ids))
+
+	query := fmt.Sprintf("SELECT gameId, path FROM game_data WHERE gameId IN (%s)", idPlaceholders(len(ids)))
+	rows, err := timedQuery("/get/batch", query, idsToArgs(ids)...)
+	if err != nil {
+		errorLog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for rows.Next() {
+		var id, path string
+		if err := rows.Scan(&id, &path); err != nil && err != sql.ErrNoRows {
+			errorLog.Println(err)
+			break
+		}
+		gameZips[id] = path
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"batch.zip\"")
+
+	archive := zip.NewWriter(w)
+	errs := make(map[string]string)
+
+	for _, id := range ids {
+		gameZip, ok := gameZips[id]
+		if !ok {
+			errs[id] = "not found"
+			continue
+		}
+
+		gameZipFile, err := os.Open(filepath.Join(config.GameZipPath, gameZip))
+		if err != nil {
+			errorLog.Println(err)
+			errs[id] = "cannot read archive"
+			continue
+		}
+
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: id + ".zip", Method: zip.Store})
+		if err != nil {
+			errorLog.Println(err)
+			errs[id] = "cannot write archive entry"
+			gameZipFile.Close()
+			continue
+		}
+		if _, err := io.Copy(entry, gameZipFile); err != nil {
+			errorLog.Println(err)
+			errs[id] = "cannot write archive entry"
+		}
+		gameZipFile.Close()
+	}
+
+	if len(errs) > 0 {
+		if entry, err := archive.Create("errors.json"); err == nil {
+			if data, err := json.Marshal(errs); err == nil {
+				entry.Write(data)
+			}
+		}
+	}
+
+	archive.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chai2010/webp"
+)
+
+// defaultImageCacheMaxAge is used when config.ImageCacheMaxAge is unset (0),
+// so immutable, content-hash-keyed responses still get a sane CDN lifetime.
+const defaultImageCacheMaxAge = 30 * 24 * 60 * 60
+
+// cachedImage is one rendered variant of a source image: its encoded bytes
+// and the Content-Type they were encoded with.
+type cachedImage struct {
+	data        []byte
+	contentType string
+}
+
+// imageLRU is the in-process first tier of the resized-image cache; the
+// on-disk directory at config.ImageCachePath is the second tier, both
+// keyed by imageCacheKey.
+var imageLRU *lruImageCache
+
+// lruImageCache is a size- and count-bounded LRU cache of encoded image variants.
+type lruImageCache struct {
+	mu       sync.Mutex
+	maxCount int
+	maxBytes int64
+	curBytes int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type lruImageEntry struct {
+	key   string
+	image cachedImage
+}
+
+func newLRUImageCache(maxCount int, maxBytes int64) *lruImageCache {
+	return &lruImageCache{
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruImageCache) Get(key string) (cachedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return cachedImage{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruImageEntry).image, true
+}
+
+func (c *lruImageCache) Put(key string, img cachedImage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.curBytes -= int64(len(el.Value.(*lruImageEntry).image.data))
+		el.Value = &lruImageEntry{key: key, image: img}
+		c.curBytes += int64(len(img.data))
+		c.order.MoveToFront(el)
+	} else {
+		el := c.order.PushFront(&lruImageEntry{key: key, image: img})
+		c.items[key] = el
+		c.curBytes += int64(len(img.data))
+	}
+
+	for (c.maxCount > 0 && c.order.Len() > c.maxCount) || (c.maxBytes > 0 && c.curBytes > c.maxBytes) {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*lruImageEntry)
+		delete(c.items, entry.key)
+		c.curBytes -= int64(len(entry.image.data))
+	}
+}
+
+// imageCacheKey hashes the inputs that fully determine an encoded image
+// variant, so a cache hit can skip decoding the source file entirely.
+func imageCacheKey(sourcePath string, mtime time.Time, width, height int, format string, quality int) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s|%d|%d|%d|%s|%d", sourcePath, mtime.UnixNano(), width, height, format, quality)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func diskCachePath(key string) string {
+	return filepath.Join(config.ImageCachePath, key[0:2], key)
+}
+
+// imageContentType maps a negotiated format to the Content-Type encodeImage
+// produces for it.
+func imageContentType(format string) string {
+	switch format {
+	case "jpeg":
+		return "image/jpeg"
+	case "webp":
+		return "image/webp"
+	case "avif":
+		return "image/avif"
+	default:
+		return "image/png"
+	}
+}
+
+func readDiskCache(key, format string) (cachedImage, bool) {
+	if config.ImageCachePath == "" {
+		return cachedImage{}, false
+	}
+
+	data, err := os.ReadFile(diskCachePath(key))
+	if err != nil {
+		return cachedImage{}, false
+	}
+
+	return cachedImage{data: data, contentType: imageContentType(format)}, true
+}
+
+// writeDiskCache persists img to the on-disk cache atomically via a
+// temp-file-then-rename, so a concurrent reader never sees a partial file.
+func writeDiskCache(key string, img cachedImage) error {
+	if config.ImageCachePath == "" {
+		return nil
+	}
+
+	path := diskCachePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(img.data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// negotiateImageFormat resolves the output format: an explicit ?format=
+// wins, otherwise it's negotiated from the Accept header.
+func negotiateImageFormat(explicit, accept string) string {
+	switch strings.ToLower(explicit) {
+	case "jpeg", "webp", "avif", "png":
+		return strings.ToLower(explicit)
+	}
+
+	if avifSupported && strings.Contains(accept, "image/avif") {
+		return "avif"
+	}
+	if strings.Contains(accept, "image/webp") {
+		return "webp"
+	}
+
+	return "png"
+}
+
+// encodeImage renders img in the requested format and returns the bytes
+// along with the Content-Type they were encoded with.
+func encodeImage(img image.Image, format string, quality int) (cachedImage, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "jpeg":
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		return cachedImage{data: buf.Bytes(), contentType: "image/jpeg"}, err
+	case "webp":
+		err := webp.Encode(&buf, img, &webp.Options{Quality: float32(quality)})
+		return cachedImage{data: buf.Bytes(), contentType: "image/webp"}, err
+	case "avif":
+		err := encodeAVIF(&buf, img, quality)
+		return cachedImage{data: buf.Bytes(), contentType: "image/avif"}, err
+	default:
+		err := png.Encode(&buf, img)
+		return cachedImage{data: buf.Bytes(), contentType: "image/png"}, err
+	}
+}
@@ -0,0 +1,18 @@
+//go:build avif
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/Kagami/go-avif"
+)
+
+// avifSupported reports whether this binary was built with AVIF encoding
+// (`go build -tags avif`), which requires a CGO AVIF encoder at build time.
+const avifSupported = true
+
+func encodeAVIF(w io.Writer, img image.Image, quality int) error {
+	return avif.Encode(w, img, &avif.Options{Quality: quality})
+}
@@ -0,0 +1,17 @@
+//go:build !avif
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// avifSupported is false in the default build; AVIF encoding requires CGO
+// and is only compiled in with `go build -tags avif`.
+const avifSupported = false
+
+func encodeAVIF(w io.Writer, img image.Image, quality int) error {
+	return errors.New("avif support not built (rebuild with -tags avif)")
+}
@@ -4,11 +4,10 @@ import (
 	"archive/zip"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"image"
 	_ "image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"log"
 	"net/http"
@@ -24,16 +23,25 @@ import (
 )
 
 type Config struct {
-	DatabasePath   string   `json:"databasePath"`
-	GameZipPath    string   `json:"gameZipPath"`
-	LegacyPath     string   `json:"legacyPath"`
-	ImagePath      string   `json:"imagePath"`
-	ErrorImageFile string   `json:"errorImageFile"`
-	LogFile        string   `json:"logFile"`
-	LogActivity    bool     `json:"logActivity"`
-	SearchLimit    int      `json:"searchLimit"`
-	MetadataFields []Field  `json:"metadataFields"`
-	FilteredTags   []string `json:"filteredTags"`
+	DatabasePath       string   `json:"databasePath"`
+	GameZipPath        string   `json:"gameZipPath"`
+	LegacyPath         string   `json:"legacyPath"`
+	ImagePath          string   `json:"imagePath"`
+	ErrorImageFile     string   `json:"errorImageFile"`
+	LogFile            string   `json:"logFile"`
+	LogActivity        bool     `json:"logActivity"`
+	LogFormat          string   `json:"logFormat"`
+	SearchLimit        int      `json:"searchLimit"`
+	MetadataFields     []Field  `json:"metadataFields"`
+	FilteredTags       []string `json:"filteredTags"`
+	SigningSecret      string   `json:"signingSecret"`
+	RateLimit          float64  `json:"rateLimit"`
+	RateBurst          int      `json:"rateBurst"`
+	TrustProxyHeaders  bool     `json:"trustProxyHeaders"`
+	ImageCachePath     string   `json:"imageCachePath"`
+	ImageCacheMax      int      `json:"imageCacheMax"`
+	ImageCacheMaxBytes int64    `json:"imageCacheMaxBytes"`
+	ImageCacheMaxAge   int      `json:"imageCacheMaxAge"`
 }
 
 type Field struct {
@@ -87,6 +95,9 @@ var (
 )
 
 func main() {
+	rebuildFTS := flag.Bool("rebuildfts", false, "rebuild the game_fts search index from the game table, then exit")
+	flag.Parse()
+
 	configRaw, err := os.ReadFile("config.json")
 	if err != nil {
 		log.Fatal("cannot read config.json")
@@ -114,6 +125,25 @@ func main() {
 	defer db.Close()
 	log.Println("connected to Flashpoint database")
 
+	if err := ensureFTSSchema(); err != nil {
+		log.Println("game_fts index unavailable, falling back to LIKE-only search: ", err)
+	} else {
+		ftsAvailable = true
+	}
+
+	imageLRU = newLRUImageCache(config.ImageCacheMax, config.ImageCacheMaxBytes)
+
+	if *rebuildFTS {
+		if !ftsAvailable {
+			log.Fatal("cannot rebuild game_fts index: fts5 module not available in this sqlite3 build")
+		}
+		if err := rebuildFTSIndex(); err != nil {
+			log.Fatal("cannot rebuild game_fts index: ", err)
+		}
+		log.Println("rebuilt game_fts index")
+		return
+	}
+
 	var errorOutput io.Writer
 	var serverOutput io.Writer
 	if config.LogFile != "" {
@@ -143,22 +173,30 @@ func main() {
 
 	errorLog = log.New(errorOutput, "error: ", log.Ldate|log.Ltime|log.Lshortfile)
 	serverLog = log.New(serverOutput, "server: ", log.Ldate|log.Ltime)
+	requestLogger = newRequestLogger(serverOutput, strings.ToLower(config.LogFormat))
+
+	http.HandleFunc("/metrics", metricsHandler.ServeHTTP)
 
-	http.HandleFunc("/search", searchHandler)
-	http.HandleFunc("/addapps", addAppsHandler)
-	http.HandleFunc("/tags", tagsHandler)
-	http.HandleFunc("/platforms", platformsHandler)
-	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/search", instrumentHandler("/search", searchHandler))
+	http.HandleFunc("/addapps", instrumentHandler("/addapps", addAppsHandler))
+	http.HandleFunc("/addapps/batch", instrumentHandler("/addapps/batch", addAppsBatchHandler))
+	http.HandleFunc("/tags", instrumentHandler("/tags", tagsHandler))
+	http.HandleFunc("/platforms", instrumentHandler("/platforms", platformsHandler))
+	http.HandleFunc("/stats", instrumentHandler("/stats", statsHandler))
+
+	http.HandleFunc("/sign", instrumentHandler("/sign", signHandler))
 
 	if config.GameZipPath != "" || config.LegacyPath != "" {
-		http.HandleFunc("/get", getHandler)
+		http.HandleFunc("/get", instrumentHandler("/get", requireRateLimit(requireSignedURL(getHandler))))
 	}
 	if config.GameZipPath != "" {
-		http.HandleFunc("/files", filesHandler)
+		http.HandleFunc("/get/batch", instrumentHandler("/get/batch", requireRateLimit(requireSignedURL(getBatchHandler))))
+		http.HandleFunc("/files", instrumentHandler("/files", requireRateLimit(requireSignedURL(filesHandler))))
+		http.HandleFunc("/files/batch", instrumentHandler("/files/batch", requireRateLimit(requireSignedURL(filesBatchHandler))))
 	}
 	if config.ImagePath != "" {
-		http.HandleFunc("/logo", imageHandler)
-		http.HandleFunc("/screenshot", imageHandler)
+		http.HandleFunc("/logo", instrumentHandler("/logo", requireRateLimit(requireSignedURL(imageHandler))))
+		http.HandleFunc("/screenshot", instrumentHandler("/screenshot", requireRateLimit(requireSignedURL(imageHandler))))
 	}
 
 	server := &http.Server{
@@ -175,6 +213,8 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	setSharedHeadersAndLog(w, r, true)
 
 	jsonObjects := make([]string, 0)
+	var totalEstimate int64
+	var nextCursor string
 
 	urlQuery := r.URL.Query()
 	operator := " AND "
@@ -188,8 +228,24 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 	param := 1
 
-	if urlQuery.Get("smartSearch") != "" {
-		for _, v := range strings.Split(urlQuery.Get("smartSearch"), ",") {
+	ftsOperator := "AND"
+	if operator == " OR " {
+		ftsOperator = "OR"
+	}
+
+	ftsMode := ftsAvailable && strings.ToLower(urlQuery.Get("mode")) == "fts"
+	smartSearchRaw := urlQuery.Get("smartSearch")
+	useFTS := ftsAvailable && smartSearchRaw != "" && ftsQueryable(smartSearchRaw)
+	ftsExprs := make([]string, 0)
+	ftsFields := make(map[string]bool, len(ftsColumns))
+	for _, c := range ftsColumns {
+		ftsFields[c] = true
+	}
+
+	if useFTS {
+		ftsExprs = append(ftsExprs, "("+translateToFTSQuery(strings.ReplaceAll(smartSearchRaw, ",", " "))+")")
+	} else if smartSearchRaw != "" {
+		for _, v := range strings.Split(smartSearchRaw, ",") {
 			smartLike := make([]string, 0)
 			for _, i := range []int{2, 3, 4, 5, 6} {
 				smartLike = append(smartLike, fmt.Sprintf("%s LIKE $%d ESCAPE '^'", fieldIterator.Name[i], param))
@@ -201,22 +257,60 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	for i, c := range fieldIterator.Name {
-		metaLike := make([]string, 0)
-		if urlQuery.Get(c) != "" {
-			for _, v := range strings.Split(urlQuery.Get(c), ",") {
-				metaLike = append(metaLike, fmt.Sprintf("%s LIKE $%d ESCAPE '^'", fieldIterator.ColumnName[i], param))
-				whereVal = append(whereVal, "%"+queryReplacer.Replace(v)+"%")
-				param++
-			}
-			if !slices.Contains(outputQueries, fieldIterator.Query[i]) {
-				outputQueries = append(outputQueries, fieldIterator.Query[i])
+		value := urlQuery.Get(c)
+		if value == "" {
+			continue
+		}
+
+		if ftsMode && ftsFields[c] && ftsQueryable(value) {
+			fieldTerms := make([]string, 0)
+			for _, v := range strings.Split(value, ",") {
+				fieldTerms = append(fieldTerms, fmt.Sprintf("%s:%s", c, translateToFTSQuery(v)))
 			}
+			ftsExprs = append(ftsExprs, "("+strings.Join(fieldTerms, " "+ftsOperator+" ")+")")
+			useFTS = true
+			continue
+		}
+
+		metaLike := make([]string, 0)
+		for _, v := range strings.Split(value, ",") {
+			metaLike = append(metaLike, fmt.Sprintf("%s LIKE $%d ESCAPE '^'", fieldIterator.ColumnName[i], param))
+			whereVal = append(whereVal, "%"+queryReplacer.Replace(v)+"%")
+			param++
+		}
+		if !slices.Contains(outputQueries, fieldIterator.Query[i]) {
+			outputQueries = append(outputQueries, fieldIterator.Query[i])
 		}
 		if len(metaLike) > 0 {
 			whereLike = append(whereLike, "("+strings.Join(metaLike, operator)+")")
 		}
 	}
 
+	ftsParam := 0
+	if useFTS {
+		ftsParam = param
+		whereVal = append(whereVal, strings.Join(ftsExprs, " "+ftsOperator+" "))
+		param++
+	}
+
+	if qExpr := urlQuery.Get("q"); qExpr != "" {
+		node, err := parseQueryDSL(qExpr)
+		if err == nil {
+			var sqlFrag string
+			var qArgs []string
+			sqlFrag, qArgs, err = node.compile(&param)
+			if err == nil {
+				whereLike = append(whereLike, sqlFrag)
+				whereVal = append(whereVal, qArgs...)
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
 	if len(whereVal) > 0 {
 		outputIndices := make([]int, 0)
 		outputColumns := make([]string, 0)
@@ -242,6 +336,25 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 			outputTagsAppend = true
 		}
 
+		dateAddedIndex := slices.Index(fieldIterator.Name, "dateAdded")
+		idIndex := slices.Index(fieldIterator.Name, "id")
+		paginate := dateAddedIndex != -1 && idIndex != -1
+
+		outputDateAddedIndex, outputDateAddedAppend := -1, false
+		outputIdIndex, outputIdAppend := -1, false
+		if paginate {
+			if outputDateAddedIndex = slices.Index(outputIndices, dateAddedIndex); outputDateAddedIndex == -1 {
+				outputIndices = append(outputIndices, dateAddedIndex)
+				outputDateAddedIndex = len(outputIndices) - 1
+				outputDateAddedAppend = true
+			}
+			if outputIdIndex = slices.Index(outputIndices, idIndex); outputIdIndex == -1 {
+				outputIndices = append(outputIndices, idIndex)
+				outputIdIndex = len(outputIndices) - 1
+				outputIdAppend = true
+			}
+		}
+
 		for _, i := range outputIndices {
 			outputColumns = append(outputColumns, fieldIterator.ColumnName[i])
 			if !slices.Contains(outputQueries, fieldIterator.Query[i]) {
@@ -249,6 +362,12 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		snippetRequested := useFTS && strings.ToLower(urlQuery.Get("snippet")) == "true"
+		if snippetRequested {
+			outputQueries = append(outputQueries, `snippet(game_fts, -1, '<mark>', '</mark>', '…', 10) AS _snippet`)
+			outputColumns = append(outputColumns, "_snippet")
+		}
+
 		var dbQuery string
 		var mergeText string
 		for i, q := range fieldIterator.Query {
@@ -257,7 +376,51 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		}
-		dbQuery = fmt.Sprintf(`SELECT %s FROM (SELECT %s FROM game%s) WHERE %s`, strings.Join(outputColumns, ","), strings.Join(outputQueries, ","), mergeText, strings.Join(whereLike, operator))
+
+		var innerWhere, innerOrderBy string
+		orderByParam := urlQuery.Get("orderBy")
+		if useFTS {
+			mergeText += " JOIN game_fts ON game.id=game_fts.id"
+			innerWhere = fmt.Sprintf(" WHERE game_fts MATCH $%d", ftsParam)
+			if orderByParam == "" || orderByParam == "relevance" {
+				innerOrderBy = " ORDER BY bm25(game_fts)"
+			}
+		}
+
+		outerWhere := "1=1"
+		if len(whereLike) > 0 {
+			outerWhere = strings.Join(whereLike, operator)
+		}
+
+		paginate = paginate && innerOrderBy == ""
+		if paginate {
+			if cursor, ok := decodeCursor(urlQuery.Get("cursor")); ok {
+				dateAddedParam, idParam := param, param+1
+				param += 2
+				whereVal = append(whereVal, cursor.DateAdded, cursor.ID)
+				outerWhere = fmt.Sprintf("(%s) AND (%s > $%d OR (%s = $%d AND %s > $%d))",
+					outerWhere,
+					fieldIterator.ColumnName[dateAddedIndex], dateAddedParam,
+					fieldIterator.ColumnName[dateAddedIndex], dateAddedParam,
+					fieldIterator.ColumnName[idIndex], idParam)
+			}
+		}
+
+		dbQuery = fmt.Sprintf(`SELECT %s FROM (SELECT %s FROM game%s%s%s) WHERE %s`, strings.Join(outputColumns, ","), strings.Join(outputQueries, ","), mergeText, innerWhere, innerOrderBy, outerWhere)
+
+		if paginate {
+			orderColumn := fieldIterator.ColumnName[dateAddedIndex]
+			if orderByParam == "title" {
+				if i := slices.Index(fieldIterator.Name, "title"); i != -1 {
+					orderColumn = fieldIterator.ColumnName[i]
+				}
+			}
+			dbQuery += fmt.Sprintf(" ORDER BY %s, %s", orderColumn, fieldIterator.ColumnName[idIndex])
+		} else if innerOrderBy == "" && (orderByParam == "title" || orderByParam == "dateAdded") {
+			if i := slices.Index(fieldIterator.Name, orderByParam); i != -1 && slices.Contains(outputColumns, fieldIterator.ColumnName[i]) {
+				dbQuery += " ORDER BY " + fieldIterator.ColumnName[i]
+			}
+		}
 
 		limit := config.SearchLimit
 		if urlQuery.Has("limit") {
@@ -266,8 +429,12 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 				limit = i
 			}
 		}
-		if limit > 0 {
-			dbQuery += fmt.Sprintf(" LIMIT %d", limit)
+		fetchLimit := limit
+		if paginate && fetchLimit > 0 {
+			fetchLimit++
+		}
+		if fetchLimit > 0 {
+			dbQuery += fmt.Sprintf(" LIMIT %d", fetchLimit)
 		}
 
 		args := make([]interface{}, len(whereVal))
@@ -275,16 +442,52 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 			args[i] = v
 		}
 
-		rows, err := db.Query(dbQuery, args...)
+		if paginate {
+			countQueries := outputQueries
+			if snippetRequested {
+				countQueries = outputQueries[:len(outputQueries)-1]
+			}
+			countQuery := fmt.Sprintf(`SELECT COUNT(*) FROM (SELECT %s FROM game%s%s) WHERE %s`, strings.Join(countQueries, ","), mergeText, innerWhere, outerWhere)
+			if err := timeDBQuery("/search", func() error {
+				return db.QueryRow(countQuery, args...).Scan(&totalEstimate)
+			}); err != nil {
+				errorLog.Println(err)
+			}
+		}
+
+		var rows *sql.Rows
+		err := timeDBQuery("/search", func() error {
+			var queryErr error
+			rows, queryErr = db.Query(dbQuery, args...)
+			return queryErr
+		})
 		if err != nil {
 			errorLog.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		entryLen := len(outputIndices)
+		if snippetRequested {
+			entryLen++
+		}
+
+		trimCount := 0
+		if outputTagsAppend {
+			trimCount++
+		}
+		if outputDateAddedAppend {
+			trimCount++
+		}
+		if outputIdAppend {
+			trimCount++
+		}
+
+		pageCursors := make([]searchCursor, 0)
+
 		for rows.Next() {
-			entry := make([]string, len(outputIndices))
-			pipe := make([]interface{}, len(outputIndices))
+			entry := make([]string, entryLen)
+			pipe := make([]interface{}, entryLen)
 			for i := range pipe {
 				pipe[i] = &entry[i]
 			}
@@ -326,10 +529,21 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 			if filtered {
 				continue
-			} else if outputTagsAppend {
+			}
+
+			var snippetText string
+			if snippetRequested {
+				snippetText = entry[len(entry)-1]
 				entry = entry[:len(entry)-1]
 			}
 
+			if paginate {
+				pageCursors = append(pageCursors, searchCursor{DateAdded: entry[outputDateAddedIndex], ID: entry[outputIdIndex]})
+			}
+			if trimCount > 0 {
+				entry = entry[:len(entry)-trimCount]
+			}
+
 			jsonObject := "{"
 			for i, v := range entry {
 				fieldIndex := outputIndices[i]
@@ -344,18 +558,53 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 						jsonObject += string(jsonValue)
 					}
 				}
-				if i != len(entry)-1 {
-					jsonObject += ","
+				jsonObject += ","
+			}
+			if snippetRequested {
+				if jsonValue, err := json.Marshal(snippetText); err == nil {
+					jsonObject += `"snippet":` + string(jsonValue)
 				}
+			} else {
+				jsonObject = strings.TrimSuffix(jsonObject, ",")
 			}
 			jsonObject += "}"
 
 			jsonObjects = append(jsonObjects, jsonObject)
 		}
+
+		if paginate && limit > 0 && len(jsonObjects) > limit {
+			jsonObjects = jsonObjects[:limit]
+			pageCursors = pageCursors[:limit]
+			nextCursor = encodeCursor(pageCursors[len(pageCursors)-1])
+		}
 	}
 
+	recordRowsReturned(r, len(jsonObjects))
+	searchResultsTotal.Add(float64(len(jsonObjects)))
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte("[" + strings.Join(jsonObjects, ",") + "]"))
+	if totalEstimate > 0 {
+		w.Header().Set("X-Total-Estimate", strconv.FormatInt(totalEstimate, 10))
+	}
+	if nextCursor != "" {
+		nextQuery := urlQuery
+		nextQuery.Set("cursor", nextCursor)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, nextQuery.Encode()))
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+
+	w.Write([]byte("["))
+	for i, jsonObject := range jsonObjects {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write([]byte(jsonObject))
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	w.Write([]byte("]"))
 }
 
 func addAppsHandler(w http.ResponseWriter, r *http.Request) {
@@ -365,7 +614,7 @@ func addAppsHandler(w http.ResponseWriter, r *http.Request) {
 	urlQuery := r.URL.Query()
 
 	if urlQuery.Has("id") {
-		rows, err := db.Query("SELECT id, applicationPath, autoRunBefore, launchCommand, name FROM additional_app WHERE parentGameId = ?", urlQuery.Get("id"))
+		rows, err := timedQuery("/addapps", "SELECT id, applicationPath, autoRunBefore, launchCommand, name FROM additional_app WHERE parentGameId = ?", urlQuery.Get("id"))
 		if err != nil {
 			errorLog.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -385,6 +634,7 @@ func addAppsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	recordRowsReturned(r, len(addApps))
 	marshalAndWrite(addApps, w)
 }
 
@@ -393,7 +643,7 @@ func tagsHandler(w http.ResponseWriter, r *http.Request) {
 
 	tags := make([]Tag, 0)
 
-	rows, err := db.Query("SELECT tag_alias_concat.aliases, tag_category.name FROM (SELECT id, group_concat(name, '; ') AS aliases FROM tag_alias GROUP BY tagId) tag_alias_concat JOIN tag, tag_category ON tag_alias_concat.id = tag.primaryAliasId AND tag.categoryId = tag_category.id")
+	rows, err := timedQuery("/tags", "SELECT tag_alias_concat.aliases, tag_category.name FROM (SELECT id, group_concat(name, '; ') AS aliases FROM tag_alias GROUP BY tagId) tag_alias_concat JOIN tag, tag_category ON tag_alias_concat.id = tag.primaryAliasId AND tag.categoryId = tag_category.id")
 	if err != nil {
 		errorLog.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -415,6 +665,7 @@ func tagsHandler(w http.ResponseWriter, r *http.Request) {
 		tags = append(tags, tag)
 	}
 
+	recordRowsReturned(r, len(tags))
 	marshalAndWrite(tags, w)
 }
 
@@ -423,7 +674,7 @@ func platformsHandler(w http.ResponseWriter, r *http.Request) {
 
 	platforms := make([]string, 0)
 
-	rows, err := db.Query("SELECT name FROM platform_alias")
+	rows, err := timedQuery("/platforms", "SELECT name FROM platform_alias")
 	if err != nil {
 		errorLog.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -442,6 +693,7 @@ func platformsHandler(w http.ResponseWriter, r *http.Request) {
 		platforms = append(platforms, platform)
 	}
 
+	recordRowsReturned(r, len(platforms))
 	marshalAndWrite(platforms, w)
 }
 
@@ -454,8 +706,10 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 	if urlQuery.Has("id") {
 		var gameZip string
 
-		row := db.QueryRow("SELECT path FROM game_data WHERE gameId = ?", urlQuery.Get("id"))
-		if err := row.Scan(&gameZip); err == nil {
+		err := timeDBQuery("/files", func() error {
+			return db.QueryRow("SELECT path FROM game_data WHERE gameId = ?", urlQuery.Get("id")).Scan(&gameZip)
+		})
+		if err == nil {
 			zip, err := zip.OpenReader(filepath.Join(config.GameZipPath, gameZip))
 			if err == nil {
 				defer zip.Close()
@@ -473,6 +727,7 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	recordRowsReturned(r, len(files))
 	marshalAndWrite(files, w)
 }
 
@@ -495,7 +750,7 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	for i := 0; i < 3; i++ {
 		*totals[i] = make([]ColumnStats, 0)
 
-		rows, err := db.Query(queries[i])
+		rows, err := timedQuery("/stats", queries[i])
 		if err != nil {
 			errorLog.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -514,6 +769,7 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	recordRowsReturned(r, len(stats.LibraryTotals)+len(stats.FormatTotals)+len(stats.PlatformTotals))
 	marshalAndWrite(stats, w)
 }
 
@@ -525,13 +781,18 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 	if urlQuery.Has("id") && config.GameZipPath != "" {
 		var gameZip string
 
-		row := db.QueryRow("SELECT path FROM game_data WHERE gameId = ?", urlQuery.Get("id"))
-		if err := row.Scan(&gameZip); err == nil {
-			if gameZipData, err := os.ReadFile(filepath.Join(config.GameZipPath, gameZip)); err == nil {
+		err := timeDBQuery("/get", func() error {
+			return db.QueryRow("SELECT path FROM game_data WHERE gameId = ?", urlQuery.Get("id")).Scan(&gameZip)
+		})
+		if err == nil {
+			gameZipPath := filepath.Join(config.GameZipPath, gameZip)
+			if gameZipFile, info, err := openForServing(gameZipPath); err == nil {
+				defer gameZipFile.Close()
+
 				w.Header().Set("Content-Type", "application/zip")
 				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", gameZip))
 
-				w.Write(gameZipData)
+				http.ServeContent(w, r, gameZip, info.ModTime(), gameZipFile)
 				return
 			} else {
 				errorLog.Println(err)
@@ -544,11 +805,13 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 		file := filepath.Join(config.LegacyPath, strings.ReplaceAll(url, "/", string(os.PathSeparator)))
 
 		if strings.HasPrefix(file, config.LegacyPath) {
-			if fileData, err := os.ReadFile(file); err == nil {
+			if legacyFile, info, err := openForServing(file); err == nil {
+				defer legacyFile.Close()
+
 				w.Header().Set("Content-Type", "application/octet-stream")
 				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", url[strings.LastIndex(url, "/")+1:]))
 
-				w.Write(fileData)
+				http.ServeContent(w, r, file, info.ModTime(), legacyFile)
 				return
 			} else {
 				errorLog.Println(err)
@@ -581,78 +844,131 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 		imageFile = config.ErrorImageFile
 	}
 
-	var imageRaw *os.File
-	for {
-		image, err := os.Open(imageFile)
-		if err != nil && imageFile != config.ErrorImageFile {
-			imageFile = config.ErrorImageFile
-		} else if err != nil {
+	// A single fallback to the configured error image is allowed; if that
+	// is also missing, give up with a 404 instead of looping forever.
+	imageRaw, err := os.Open(imageFile)
+	if err != nil {
+		if imageFile == config.ErrorImageFile {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		imageFile = config.ErrorImageFile
+		imageRaw, err = os.Open(imageFile)
+		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
-		} else {
-			imageRaw = image
-			break
 		}
 	}
 	defer imageRaw.Close()
 
-	imageData, _, err := image.Decode(imageRaw)
+	info, err := imageRaw.Stat()
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	width, height := 0, 0
 	if urlQuery.Has("width") {
-		i, err := strconv.Atoi(urlQuery.Get("width"))
-		if err == nil && i > 0 && i <= imageData.Bounds().Max.X {
-			width := i
-			height := int(float32(imageData.Bounds().Max.Y) * (float32(width) / float32(imageData.Bounds().Max.X)))
-
-			if height > 0 {
-				imageScaled := image.NewRGBA(image.Rect(0, 0, width, height))
-				draw.BiLinear.Scale(imageScaled, imageScaled.Rect, imageData, imageData.Bounds(), draw.Over, nil)
-				imageData = imageScaled
-			}
+		if i, err := strconv.Atoi(urlQuery.Get("width")); err == nil && i > 0 {
+			width = i
 		}
 	} else if urlQuery.Has("height") {
-		i, err := strconv.Atoi(urlQuery.Get("height"))
-		if err == nil && i > 0 && i <= imageData.Bounds().Max.Y {
-			height := i
-			width := int(float32(imageData.Bounds().Max.X) * (float32(height) / float32(imageData.Bounds().Max.Y)))
-
-			if width > 0 {
-				imageScaled := image.NewRGBA(image.Rect(0, 0, width, height))
-				draw.BiLinear.Scale(imageScaled, imageScaled.Rect, imageData, imageData.Bounds(), draw.Over, nil)
-				imageData = imageScaled
-			}
+		if i, err := strconv.Atoi(urlQuery.Get("height")); err == nil && i > 0 {
+			height = i
 		}
 	}
 
-	if urlQuery.Has("format") && strings.ToLower(urlQuery.Get("format")) == "jpeg" {
-		w.Header().Set("Content-Type", "image/jpeg")
+	quality := 80
+	if urlQuery.Has("quality") {
+		if i, err := strconv.Atoi(urlQuery.Get("quality")); err == nil && i >= 0 && i <= 100 {
+			quality = i
+		}
+	}
 
-		quality := 80
-		if urlQuery.Has("quality") {
-			i, err := strconv.Atoi(urlQuery.Get("quality"))
-			if err == nil && i >= 0 && i <= 100 {
-				quality = i
-			}
+	format := negotiateImageFormat(urlQuery.Get("format"), r.Header.Get("Accept"))
+	cacheKey := imageCacheKey(imageFile, info.ModTime(), width, height, format, quality)
+
+	etag := `"` + cacheKey + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	maxAge := config.ImageCacheMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultImageCacheMaxAge
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", maxAge))
+
+	if imageLRU != nil {
+		if cached, ok := imageLRU.Get(cacheKey); ok {
+			imageCacheHits.Inc()
+			w.Header().Set("Content-Type", cached.contentType)
+			w.Write(cached.data)
+			return
 		}
+	}
 
-		jpeg.Encode(w, imageData, &jpeg.Options{Quality: quality})
-	} else {
-		w.Header().Set("Content-Type", "image/png")
-		png.Encode(w, imageData)
+	if cached, ok := readDiskCache(cacheKey, format); ok {
+		imageCacheHits.Inc()
+		if imageLRU != nil {
+			imageLRU.Put(cacheKey, cached)
+		}
+		w.Header().Set("Content-Type", cached.contentType)
+		w.Write(cached.data)
+		return
 	}
+
+	imageData, _, err := image.Decode(imageRaw)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if width > 0 && width <= imageData.Bounds().Max.X {
+		height := int(float32(imageData.Bounds().Max.Y) * (float32(width) / float32(imageData.Bounds().Max.X)))
+		if height > 0 {
+			imageScaled := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.BiLinear.Scale(imageScaled, imageScaled.Rect, imageData, imageData.Bounds(), draw.Over, nil)
+			imageData = imageScaled
+		}
+	} else if height > 0 && height <= imageData.Bounds().Max.Y {
+		width := int(float32(imageData.Bounds().Max.X) * (float32(height) / float32(imageData.Bounds().Max.Y)))
+		if width > 0 {
+			imageScaled := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.BiLinear.Scale(imageScaled, imageScaled.Rect, imageData, imageData.Bounds(), draw.Over, nil)
+			imageData = imageScaled
+		}
+	}
+
+	cached, err := encodeImage(imageData, format, quality)
+	if err != nil {
+		errorLog.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if imageLRU != nil {
+		imageLRU.Put(cacheKey, cached)
+	}
+	if err := writeDiskCache(cacheKey, cached); err != nil {
+		errorLog.Println(err)
+	}
+
+	w.Header().Set("Content-Type", cached.contentType)
+	w.Write(cached.data)
 }
 
+// setSharedHeadersAndLog sets the headers every handler responds with.
+// Per-request activity logging now happens once, centrally, in
+// instrumentHandler, rather than as a free-text line here.
 func setSharedHeadersAndLog(w http.ResponseWriter, r *http.Request, isJson bool) {
 	if isJson {
 		w.Header().Set("Content-Type", "application/json")
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	serverLog.Printf("serving %s to %s\n", r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"))
 }
 
 func marshalAndWrite(object any, w http.ResponseWriter) {
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fpdb_http_requests_total",
+		Help: "Total HTTP requests, by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "fpdb_http_request_duration_seconds",
+		Help: "HTTP request duration in seconds, by endpoint.",
+	}, []string{"endpoint"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "fpdb_db_query_duration_seconds",
+		Help: "Database query duration in seconds, by handler.",
+	}, []string{"handler"})
+
+	imageCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fpdb_image_cache_hits_total",
+		Help: "Total image requests served from the in-process or on-disk resized-image cache.",
+	})
+
+	searchResultsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fpdb_search_results_total",
+		Help: "Total result rows returned by /search, across all requests.",
+	})
+)
+
+// requestLogger emits one structured log entry per request; format is
+// controlled by config.LogFormat ("text" or "json").
+var requestLogger *slog.Logger
+
+// newRequestLogger builds the slog.Logger main() installs as requestLogger.
+func newRequestLogger(w io.Writer, format string) *slog.Logger {
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, nil)
+	} else {
+		handler = slog.NewTextHandler(w, nil)
+	}
+	return slog.New(handler)
+}
+
+// newRequestID returns a short random hex id for correlating log lines.
+func newRequestID() string {
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(raw[:])
+}
+
+type rowsReturnedCtxKey struct{}
+
+// withRowsReturnedRecorder attaches an int the handler can fill in with the
+// number of rows it returned, for the request log.
+func withRowsReturnedRecorder(r *http.Request) (*http.Request, *int) {
+	rows := new(int)
+	return r.WithContext(context.WithValue(r.Context(), rowsReturnedCtxKey{}, rows)), rows
+}
+
+// recordRowsReturned lets a handler report how many rows it returned. A
+// no-op if the request wasn't wrapped by instrumentHandler.
+func recordRowsReturned(r *http.Request, n int) {
+	if rows, ok := r.Context().Value(rowsReturnedCtxKey{}).(*int); ok {
+		*rows = n
+	}
+}
+
+// timeDBQuery runs fn, recording its duration under
+// fpdb_db_query_duration_seconds{handler=label}.
+func timeDBQuery(label string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	dbQueryDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// timedQuery is timeDBQuery specialized for a plain db.Query call.
+func timedQuery(label, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := timeDBQuery(label, func() error {
+		var queryErr error
+		rows, queryErr = db.Query(query, args...)
+		return queryErr
+	})
+	return rows, err
+}
+
+// statusRecorder captures the status code a handler wrote, defaulting to
+// 200 if it never calls WriteHeader explicitly.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.wrote = true
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if !s.wrote {
+		s.status = http.StatusOK
+		s.wrote = true
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush preserves streaming support through the wrapper.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrumentHandler wraps next with Prometheus metrics and a structured
+// request log entry.
+func instrumentHandler(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := newRequestID()
+		rc, rows := withRowsReturnedRecorder(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next(recorder, rc)
+
+		duration := time.Since(start)
+		status := strconv.Itoa(recorder.status)
+
+		httpRequestsTotal.WithLabelValues(endpoint, status).Inc()
+		httpRequestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+
+		requestLogger.Info("request",
+			"request_id", requestID,
+			"method", r.Method,
+			"endpoint", endpoint,
+			"path", r.URL.Path,
+			"xff", r.Header.Get("X-Forwarded-For"),
+			"status", recorder.status,
+			"duration_ms", duration.Milliseconds(),
+			"rows_returned", *rows,
+		)
+	}
+}
+
+// metricsHandler exposes the Prometheus registry at /metrics.
+var metricsHandler = promhttp.Handler()
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// searchCursor is the keyset pagination tiebreaker for /search: the
+// (dateAdded, id) pair of the last row on the previous page. It is opaque to
+// clients, who should treat it as a base64 blob and not construct it by
+// hand.
+type searchCursor struct {
+	DateAdded string `json:"dateAdded"`
+	ID        string `json:"id"`
+}
+
+func encodeCursor(c searchCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (searchCursor, bool) {
+	var c searchCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, false
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, false
+	}
+	if c.DateAdded == "" || c.ID == "" {
+		return c, false
+	}
+	return c, true
+}
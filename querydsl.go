@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// smartSearchFields mirrors searchHandler's bare-term column set (title,
+// developer, publisher, series, alternateTitles).
+var smartSearchFields = []int{2, 3, 4, 5, 6}
+
+// dslError carries the byte offset where parsing failed, for a positional
+// 400 message.
+type dslError struct {
+	pos int
+	msg string
+}
+
+func (e *dslError) Error() string {
+	return fmt.Sprintf("query error at position %d: %s", e.pos, e.msg)
+}
+
+// dslNode is one node of the parsed ?q= expression tree.
+type dslNode interface {
+	// compile renders the node as a parameterized SQL fragment, advancing
+	// param by the number of placeholders consumed.
+	compile(param *int) (string, []string, error)
+}
+
+type dslAnd struct{ left, right dslNode }
+type dslOr struct{ left, right dslNode }
+type dslNot struct{ child dslNode }
+
+// dslField is a `field:value` comparison, including the range forms
+// (`>`, `>=`, `<`, `<=`, `lo..hi`). op == "eq" is a substring LIKE.
+type dslField struct {
+	pos    int
+	field  string
+	op     string
+	value  string
+	value2 string
+}
+
+// dslTerm is a bare word or quoted phrase with no `field:` prefix.
+type dslTerm struct{ phrase string }
+
+func (n *dslAnd) compile(param *int) (string, []string, error) {
+	return compileBinary(n.left, n.right, "AND", param)
+}
+
+func (n *dslOr) compile(param *int) (string, []string, error) {
+	return compileBinary(n.left, n.right, "OR", param)
+}
+
+func compileBinary(left, right dslNode, joiner string, param *int) (string, []string, error) {
+	leftSQL, leftArgs, err := left.compile(param)
+	if err != nil {
+		return "", nil, err
+	}
+	rightSQL, rightArgs, err := right.compile(param)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("(%s %s %s)", leftSQL, joiner, rightSQL), append(leftArgs, rightArgs...), nil
+}
+
+func (n *dslNot) compile(param *int) (string, []string, error) {
+	sql, args, err := n.child.compile(param)
+	if err != nil {
+		return "", nil, err
+	}
+	return "NOT (" + sql + ")", args, nil
+}
+
+func (n *dslField) compile(param *int) (string, []string, error) {
+	i := slices.Index(fieldIterator.Name, n.field)
+	if i == -1 {
+		return "", nil, &dslError{pos: n.pos, msg: fmt.Sprintf("unknown field %q", n.field)}
+	}
+	column := fieldIterator.ColumnName[i]
+
+	switch n.op {
+	case "eq":
+		p := *param
+		*param++
+		return fmt.Sprintf("%s LIKE $%d ESCAPE '^'", column, p), []string{"%" + queryReplacer.Replace(n.value) + "%"}, nil
+	case ">", ">=", "<", "<=":
+		p := *param
+		*param++
+		return fmt.Sprintf("%s %s $%d", column, n.op, p), []string{n.value}, nil
+	case "range":
+		lo, hi := *param, *param+1
+		*param += 2
+		return fmt.Sprintf("(%s >= $%d AND %s <= $%d)", column, lo, column, hi), []string{n.value, n.value2}, nil
+	default:
+		return "", nil, &dslError{pos: n.pos, msg: fmt.Sprintf("unsupported operator %q", n.op)}
+	}
+}
+
+func (n *dslTerm) compile(param *int) (string, []string, error) {
+	clauses := make([]string, 0, len(smartSearchFields))
+	p := *param
+	*param++
+	for _, i := range smartSearchFields {
+		clauses = append(clauses, fmt.Sprintf("%s LIKE $%d ESCAPE '^'", fieldIterator.ColumnName[i], p))
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", []string{"%" + queryReplacer.Replace(n.phrase) + "%"}, nil
+}
+
+// parseQueryDSL parses a ?q= expression into a dslNode tree. Grammar:
+//
+//	expr   := orExpr
+//	orExpr := andExpr ( OR andExpr )*
+//	andExpr:= notExpr ( [AND] notExpr )*
+//	notExpr:= NOT notExpr | primary
+//	primary:= '(' expr ')' | ['-'] field:value | ['-'] term
+//
+// A leading '-' negates only the single field:value or term it is attached
+// to; it does not apply to a parenthesized group.
+func parseQueryDSL(q string) (dslNode, error) {
+	p := &dslParser{tokens: tokenizeDSL(q)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != dslTokenEOF {
+		return nil, &dslError{pos: tok.pos, msg: fmt.Sprintf("unexpected token %q", tok.text)}
+	}
+	return node, nil
+}
+
+type dslTokenKind int
+
+const (
+	dslTokenTerm dslTokenKind = iota
+	dslTokenLParen
+	dslTokenRParen
+	dslTokenAnd
+	dslTokenOr
+	dslTokenNot
+	dslTokenEOF
+)
+
+type dslToken struct {
+	kind dslTokenKind
+	text string
+	pos  int
+}
+
+// tokenizeDSL splits a ?q= expression into tokens, keeping quoted phrases
+// intact as a single token.
+func tokenizeDSL(q string) []dslToken {
+	var tokens []dslToken
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			kind := dslTokenLParen
+			if c == ')' {
+				kind = dslTokenRParen
+			}
+			tokens = append(tokens, dslToken{kind: kind, text: string(c), pos: i})
+			i++
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(" \t\n\r()", rune(q[i])) {
+				if q[i] == '"' {
+					i++
+					for i < len(q) && q[i] != '"' {
+						i++
+					}
+					if i < len(q) {
+						i++
+					}
+					continue
+				}
+				i++
+			}
+			text := q[start:i]
+			tokens = append(tokens, dslToken{kind: classifyDSLWord(text), text: text, pos: start})
+		}
+	}
+	tokens = append(tokens, dslToken{kind: dslTokenEOF, text: "", pos: len(q)})
+	return tokens
+}
+
+func classifyDSLWord(text string) dslTokenKind {
+	switch strings.ToUpper(text) {
+	case "AND":
+		return dslTokenAnd
+	case "OR":
+		return dslTokenOr
+	case "NOT":
+		return dslTokenNot
+	default:
+		return dslTokenTerm
+	}
+}
+
+type dslParser struct {
+	tokens []dslToken
+	pos    int
+}
+
+func (p *dslParser) peek() dslToken { return p.tokens[p.pos] }
+func (p *dslParser) advance() dslToken {
+	tok := p.tokens[p.pos]
+	if p.pos < len(p.tokens)-1 {
+		p.pos++
+	}
+	return tok
+}
+func (p *dslParser) parseOr() (dslNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == dslTokenOr {
+		p.advance()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &dslOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *dslParser) parseAnd() (dslNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case dslTokenAnd:
+			p.advance()
+		case dslTokenTerm, dslTokenLParen, dslTokenNot:
+			// implicit AND between adjacent terms
+		default:
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &dslAnd{left: left, right: right}
+	}
+}
+
+func (p *dslParser) parseNot() (dslNode, error) {
+	if p.peek().kind == dslTokenNot {
+		p.advance()
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &dslNot{child: child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *dslParser) parsePrimary() (dslNode, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case dslTokenLParen:
+		p.advance()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != dslTokenRParen {
+			return nil, &dslError{pos: p.peek().pos, msg: "expected ')'"}
+		}
+		p.advance()
+		return node, nil
+	case dslTokenTerm:
+		p.advance()
+		return parseDSLTerm(tok)
+	case dslTokenEOF, dslTokenRParen:
+		return nil, &dslError{pos: tok.pos, msg: "unexpected end of query"}
+	default:
+		return nil, &dslError{pos: tok.pos, msg: fmt.Sprintf("unexpected token %q", tok.text)}
+	}
+}
+
+func unquoteDSL(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseDSLTerm interprets a TERM token as a `field:value` comparison
+// (optionally negated with a leading '-') or a bare phrase.
+func parseDSLTerm(tok dslToken) (dslNode, error) {
+	text := tok.text
+	negate := false
+	if strings.HasPrefix(text, "-") && text != "-" {
+		negate = true
+		text = text[1:]
+	}
+
+	colon := strings.IndexByte(text, ':')
+	quote := strings.IndexByte(text, '"')
+	var node dslNode
+	if colon != -1 && (quote == -1 || colon < quote) {
+		field := text[:colon]
+		rest := text[colon+1:]
+		if field == "" {
+			return nil, &dslError{pos: tok.pos, msg: "missing field name before ':'"}
+		}
+
+		f := &dslField{pos: tok.pos, field: field}
+		switch {
+		case strings.HasPrefix(rest, ">="):
+			f.op, f.value = ">=", rest[2:]
+		case strings.HasPrefix(rest, "<="):
+			f.op, f.value = "<=", rest[2:]
+		case strings.HasPrefix(rest, ">"):
+			f.op, f.value = ">", rest[1:]
+		case strings.HasPrefix(rest, "<"):
+			f.op, f.value = "<", rest[1:]
+		case strings.Contains(rest, ".."):
+			parts := strings.SplitN(rest, "..", 2)
+			f.op, f.value, f.value2 = "range", parts[0], parts[1]
+		default:
+			f.op, f.value = "eq", unquoteDSL(rest)
+		}
+		if f.value == "" || (f.op == "range" && f.value2 == "") {
+			return nil, &dslError{pos: tok.pos, msg: fmt.Sprintf("missing value for field %q", field)}
+		}
+		node = f
+	} else {
+		node = &dslTerm{phrase: unquoteDSL(text)}
+	}
+
+	if negate {
+		return &dslNot{child: node}, nil
+	}
+	return node, nil
+}
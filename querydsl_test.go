@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withTestFields installs a minimal fieldIterator matching the indices
+// querydsl.go assumes (smartSearchFields = title/developer/publisher/series/
+// alternateTitles at 2..6) plus a couple of named fields used by range
+// tests, and restores the previous value afterwards.
+func withTestFields(t *testing.T) {
+	t.Helper()
+	prev := fieldIterator
+	fieldIterator = FieldIterator{
+		Name:       []string{"id", "library", "title", "developer", "publisher", "series", "alternateTitles", "platform", "dateAdded", "playCount"},
+		ColumnName: []string{"id", "library", "title", "developer", "publisher", "series", "alternateTitles", "platform", "dateAdded", "playCount"},
+		Query:      []string{"id", "library", "title", "developer", "publisher", "series", "alternateTitles", "platform", "dateAdded", "playCount"},
+		DataTable:  []bool{false, false, false, false, false, false, false, false, false, false},
+		Type:       []string{"string", "string", "string", "string", "string", "string", "string", "string", "string", "string"},
+	}
+	t.Cleanup(func() { fieldIterator = prev })
+}
+
+func compileQ(t *testing.T, q string) (string, []string) {
+	t.Helper()
+	node, err := parseQueryDSL(q)
+	if err != nil {
+		t.Fatalf("parseQueryDSL(%q): %v", q, err)
+	}
+	param := 1
+	sql, args, err := node.compile(&param)
+	if err != nil {
+		t.Fatalf("compile(%q): %v", q, err)
+	}
+	return sql, args
+}
+
+func TestQueryDSLOperatorPrecedence(t *testing.T) {
+	withTestFields(t)
+
+	// AND binds tighter than OR: "a OR b AND c" == "a OR (b AND c)".
+	sql, _ := compileQ(t, "developer:foo OR developer:bar AND platform:Flash")
+	want := "(developer LIKE $1 ESCAPE '^' OR (developer LIKE $2 ESCAPE '^' AND platform LIKE $3 ESCAPE '^'))"
+	if sql != want {
+		t.Errorf("got %q, want %q", sql, want)
+	}
+
+	// Explicit parens override the default precedence.
+	sql, _ = compileQ(t, "(developer:foo OR developer:bar) AND platform:Flash")
+	want = "((developer LIKE $1 ESCAPE '^' OR developer LIKE $2 ESCAPE '^') AND platform LIKE $3 ESCAPE '^')"
+	if sql != want {
+		t.Errorf("got %q, want %q", sql, want)
+	}
+
+	// Adjacent terms with no operator are implicitly AND'd.
+	sql, _ = compileQ(t, `developer:foo platform:Flash`)
+	want = "(developer LIKE $1 ESCAPE '^' AND platform LIKE $2 ESCAPE '^')"
+	if sql != want {
+		t.Errorf("got %q, want %q", sql, want)
+	}
+}
+
+func TestQueryDSLNegation(t *testing.T) {
+	withTestFields(t)
+
+	sql, args := compileQ(t, "-platform:Flash")
+	if sql != "NOT (platform LIKE $1 ESCAPE '^')" {
+		t.Errorf("got %q", sql)
+	}
+	if len(args) != 1 || args[0] != "%Flash%" {
+		t.Errorf("got args %v", args)
+	}
+
+	sql, _ = compileQ(t, "developer:foo AND NOT platform:Flash")
+	want := "(developer LIKE $1 ESCAPE '^' AND NOT (platform LIKE $2 ESCAPE '^'))"
+	if sql != want {
+		t.Errorf("got %q, want %q", sql, want)
+	}
+}
+
+func TestQueryDSLRangeOperators(t *testing.T) {
+	withTestFields(t)
+
+	sql, args := compileQ(t, "playCount:1..10")
+	if sql != "(playCount >= $1 AND playCount <= $2)" {
+		t.Errorf("got %q", sql)
+	}
+	if len(args) != 2 || args[0] != "1" || args[1] != "10" {
+		t.Errorf("got args %v", args)
+	}
+
+	sql, args = compileQ(t, "dateAdded:>2020")
+	if sql != "dateAdded > $1" {
+		t.Errorf("got %q", sql)
+	}
+	if len(args) != 1 || args[0] != "2020" {
+		t.Errorf("got args %v", args)
+	}
+
+	sql, _ = compileQ(t, "dateAdded:>=2020")
+	if sql != "dateAdded >= $1" {
+		t.Errorf("got %q", sql)
+	}
+}
+
+func TestQueryDSLQuotedPhraseAndEscaping(t *testing.T) {
+	withTestFields(t)
+
+	sql, args := compileQ(t, `developer:"Foo % Bar_Baz"`)
+	if sql != "developer LIKE $1 ESCAPE '^'" {
+		t.Errorf("got %q", sql)
+	}
+	if len(args) != 1 || args[0] != "%Foo ^% Bar^_Baz%" {
+		t.Errorf("value was not escaped for LIKE, got %q", args[0])
+	}
+
+	// Bare quoted phrase with no field: prefix matches the smartSearch
+	// column set, still as a single escaped, parameterized value.
+	sql, args = compileQ(t, `"foo bar"`)
+	if !strings.Contains(sql, "title LIKE $1 ESCAPE '^'") || !strings.Contains(sql, "developer LIKE $1 ESCAPE '^'") {
+		t.Errorf("expected smartSearch columns OR'd on a single placeholder, got %q", sql)
+	}
+	if len(args) != 1 || args[0] != "%foo bar%" {
+		t.Errorf("got args %v", args)
+	}
+}
+
+func TestQueryDSLInjectionSafety(t *testing.T) {
+	withTestFields(t)
+
+	malicious := `developer:"'; DROP TABLE game; --"`
+	sql, args := compileQ(t, malicious)
+
+	// The compiled SQL is always this exact shape, regardless of the
+	// attacker-controlled value: only a $N placeholder varies by field, and
+	// the value itself must never appear in it.
+	want := "developer LIKE $1 ESCAPE '^'"
+	if sql != want {
+		t.Fatalf("attacker-controlled text leaked into SQL text: got %q, want %q", sql, want)
+	}
+	if len(args) != 1 || !strings.Contains(args[0], "DROP TABLE") {
+		t.Fatalf("expected the raw value to flow through as a bound arg, got %v", args)
+	}
+}
+
+func TestQueryDSLParseErrors(t *testing.T) {
+	withTestFields(t)
+
+	cases := []string{
+		"developer:foo)",
+		"(developer:foo",
+		"developer:",
+		":foo",
+		"unknownfield:foo",
+		"playCount:1..",
+		"playCount:..10",
+	}
+	for _, q := range cases {
+		node, err := parseQueryDSL(q)
+		if err == nil {
+			if node == nil {
+				t.Errorf("parseQueryDSL(%q): expected error, got nil node and nil error", q)
+				continue
+			}
+			param := 1
+			if _, _, err = node.compile(&param); err == nil {
+				t.Errorf("parseQueryDSL/compile(%q): expected an error, got none", q)
+				continue
+			}
+		}
+
+		var dErr *dslError
+		if !asErr(err, &dErr) {
+			t.Errorf("parseQueryDSL(%q): expected a *dslError, got %T: %v", q, err, err)
+			continue
+		}
+		if dErr.pos < 0 || dErr.pos > len(q) {
+			t.Errorf("parseQueryDSL(%q): position %d out of range", q, dErr.pos)
+		}
+	}
+}
+
+// asErr is a tiny errors.As stand-in so the test doesn't need to import
+// "errors" just for this one assertion.
+func asErr(err error, target **dslError) bool {
+	de, ok := err.(*dslError)
+	if !ok {
+		return false
+	}
+	*target = de
+	return true
+}
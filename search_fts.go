@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ftsAvailable is set at startup; the go-sqlite3 driver only includes
+// fts5 when built with its sqlite_fts5 build tag, so this may stay false.
+var ftsAvailable bool
+
+// ftsColumns must stay in sync with the CREATE VIRTUAL TABLE statement and
+// triggers in ensureFTSSchema.
+var ftsColumns = []string{"title", "developer", "publisher", "series", "alternateTitles", "notes"}
+
+// ftsUnsafe matches characters FTS5's tokenizer chokes on; queries
+// containing them fall back to the LIKE path.
+var ftsUnsafe = regexp.MustCompile(`["*^]{2,}|[\x00-\x08\x0b-\x1f]`)
+
+// ensureFTSSchema creates the game_fts shadow table and its sync triggers
+// if they don't already exist. Safe to call on every startup.
+func ensureFTSSchema() error {
+	createTable := fmt.Sprintf(
+		`CREATE VIRTUAL TABLE IF NOT EXISTS game_fts USING fts5(id UNINDEXED, %s, tokenize="porter unicode61")`,
+		strings.Join(ftsColumns, ", "),
+	)
+	if _, err := db.Exec(createTable); err != nil {
+		return err
+	}
+
+	insertCols := "id, " + strings.Join(ftsColumns, ", ")
+	insertVals := "new.id, new." + strings.Join(ftsColumns, ", new.")
+
+	triggers := []string{
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS game_fts_ai AFTER INSERT ON game BEGIN
+			INSERT INTO game_fts(%s) VALUES (%s);
+		END`, insertCols, insertVals),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS game_fts_ad AFTER DELETE ON game BEGIN
+			DELETE FROM game_fts WHERE id = old.id;
+		END`),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS game_fts_au AFTER UPDATE ON game BEGIN
+			DELETE FROM game_fts WHERE id = old.id;
+			INSERT INTO game_fts(%s) VALUES (%s);
+		END`, insertCols, insertVals),
+	}
+	for _, t := range triggers {
+		if _, err := db.Exec(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildFTSIndex truncates and repopulates game_fts from the game table,
+// via the -rebuildfts maintenance flag.
+func rebuildFTSIndex() error {
+	if _, err := db.Exec("DELETE FROM game_fts"); err != nil {
+		return err
+	}
+
+	selectCols := "id, " + strings.Join(ftsColumns, ", ")
+	_, err := db.Exec(fmt.Sprintf(
+		"INSERT INTO game_fts(%s) SELECT %s FROM game", selectCols, selectCols,
+	))
+	return err
+}
+
+// ftsQueryable reports whether raw can be safely handed to FTS5's MATCH.
+func ftsQueryable(raw string) bool {
+	if raw == "" {
+		return false
+	}
+	if ftsUnsafe.MatchString(raw) {
+		return false
+	}
+	return strings.Count(raw, `"`)%2 == 0
+}
+
+// translateToFTSQuery rewrites shorthand `-negation` into FTS5's `NOT`.
+func translateToFTSQuery(raw string) string {
+	tokens := splitRespectingQuotes(raw)
+	out := make([]string, 0, len(tokens))
+
+	for _, t := range tokens {
+		if strings.HasPrefix(t, "-") && len(t) > 1 && t[1] != '"' {
+			out = append(out, "NOT "+t[1:])
+		} else if strings.HasPrefix(t, `-"`) {
+			out = append(out, "NOT "+t[1:])
+		} else {
+			out = append(out, t)
+		}
+	}
+
+	return strings.Join(out, " ")
+}
+
+// splitRespectingQuotes splits raw on whitespace, keeping quoted phrases intact.
+func splitRespectingQuotes(raw string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case r == ' ' && !inQuotes:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
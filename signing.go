@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// openForServing opens path for use with http.ServeContent, which needs
+// both the file handle and its modification time.
+func openForServing(path string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, info, nil
+}
+
+// signTTL is how long a freshly minted /sign URL is valid for, unless the
+// caller asks for a different lifetime with ?ttl=<seconds>.
+const signTTL = 1 * time.Hour
+
+// computeSignature signs path+key+exp with the configured secret. key is a
+// single id for the single-item routes, or idsSetKey's sorted,
+// comma-joined form of the full id set for the /batch routes.
+func computeSignature(path, key string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(config.SigningSecret))
+	fmt.Fprintf(mac, "%s%s%d", path, key, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL mints a signed relative URL for path with the given id, valid
+// until exp.
+func signURL(path, id string, exp int64) string {
+	sig := computeSignature(path, id, exp)
+	return fmt.Sprintf("%s?id=%s&exp=%d&sig=%s", path, id, exp, sig)
+}
+
+// signBatchURL mints a signed URL for a /batch route, with ids carried as
+// repeated `id` query parameters so the signed request is self-contained.
+func signBatchURL(path string, ids []string, exp int64) string {
+	sig := computeSignature(path, idsSetKey(ids), exp)
+
+	q := url.Values{}
+	for _, id := range ids {
+		q.Add("id", id)
+	}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", sig)
+	return path + "?" + q.Encode()
+}
+
+// idsSetKey returns a stable, order-independent key for an id set, so a
+// signature minted for one set can't be replayed to authorize another.
+func idsSetKey(ids []string) string {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// requireSignedURL wraps a handler so it only serves requests carrying a
+// valid `exp`/`sig` pair for the request's id (see signedKey). A no-op if
+// SigningSecret isn't configured.
+func requireSignedURL(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.SigningSecret == "" {
+			next(w, r)
+			return
+		}
+
+		// A POST body's ids would replace the signed query ids in
+		// readBatchIDs, so signed batch requests are GET-only.
+		if strings.HasSuffix(r.URL.Path, "/batch") && r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		urlQuery := r.URL.Query()
+		key := signedKey(r, urlQuery)
+
+		exp, err := strconv.ParseInt(urlQuery.Get("exp"), 10, 64)
+		if err != nil || time.Now().Unix() > exp {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		expected := computeSignature(r.URL.Path, key, exp)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(urlQuery.Get("sig"))) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// signedKey returns the value a request's signature must be over: idsSetKey
+// of the `id` query parameters for a /batch route (signed batch requests
+// must use query params, not a POST body), or the single `id`/`url`
+// parameter otherwise.
+func signedKey(r *http.Request, urlQuery url.Values) string {
+	if strings.HasSuffix(r.URL.Path, "/batch") {
+		return idsSetKey(urlQuery["id"])
+	}
+
+	id := urlQuery.Get("id")
+	if id == "" {
+		id = urlQuery.Get("url")
+	}
+	return id
+}
+
+var (
+	rateLimiters   = make(map[string]*rate.Limiter)
+	rateLimitersMu sync.Mutex
+)
+
+// clientLimiter returns the token-bucket limiter for a client IP, creating
+// one on first use. Limiters are never evicted.
+func clientLimiter(ip string) *rate.Limiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	if limiter, ok := rateLimiters[ip]; ok {
+		return limiter
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(config.RateLimit), config.RateBurst)
+	rateLimiters[ip] = limiter
+	return limiter
+}
+
+// requireRateLimit wraps a handler with a per-client-IP token-bucket
+// limiter; a no-op if config.RateLimit is zero. The client IP is the host
+// part of r.RemoteAddr unless config.TrustProxyHeaders trusts X-Forwarded-For.
+func requireRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.RateLimit <= 0 {
+			next(w, r)
+			return
+		}
+
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if config.TrustProxyHeaders {
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				ip = xff
+			}
+		}
+
+		if !clientLimiter(ip).Allow() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// signHandler mints signed URLs for a batch of ids so a front-end can hand
+// them to a download manager without exposing the signing secret.
+func signHandler(w http.ResponseWriter, r *http.Request) {
+	setSharedHeadersAndLog(w, r, true)
+
+	if config.SigningSecret == "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	ids, err := readBatchIDs(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	switch path {
+	case "/get", "/logo", "/screenshot", "/files", "/get/batch", "/files/batch":
+	case "":
+		path = "/get"
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ttl := signTTL
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+
+	exp := time.Now().Add(ttl).Unix()
+
+	if strings.HasSuffix(path, "/batch") {
+		marshalAndWrite(map[string]string{"url": signBatchURL(path, ids, exp)}, w)
+		return
+	}
+
+	urls := make(map[string]string, len(ids))
+	for _, id := range ids {
+		urls[id] = signURL(path, id, exp)
+	}
+
+	marshalAndWrite(urls, w)
+}